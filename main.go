@@ -1,17 +1,26 @@
 package main
 
 import (
+	"bytes"
+	"context"
 	"crypto/tls"
+	"crypto/x509"
+	"encoding/csv"
+	"encoding/json"
 	"errors"
 	"flag"
 	"fmt"
 	"io"
+	"math"
 	"net"
 	"net/http"
 	"net/http/httptrace"
+	neturl "net/url"
 	"os"
 	"os/signal"
 	"runtime"
+	"sort"
+	"strconv"
 	"strings"
 	"time"
 )
@@ -33,6 +42,18 @@ type result struct {
 	tlsHandshakeDone  time.Time
 	roundTripStart    time.Time
 	roundTripDone     time.Time
+
+	scheduledAt time.Time
+	sentAt      time.Time
+
+	tlsState     *tls.ConnectionState
+	tlsVerifyErr error
+
+	workerID   int
+	connReused bool
+	wasIdle    bool
+	idleTime   time.Duration
+	putIdleErr error
 }
 
 func (r *result) dnsLookup() time.Duration {
@@ -55,6 +76,100 @@ func (r *result) roundTrip() time.Duration {
 	return r.roundTripDone.Sub(r.roundTripStart)
 }
 
+// queueWait is how long a request sat waiting for a free worker after its
+// scheduled send time, in open-model (-r) load generation. It is zero in
+// closed-loop mode, where there is no scheduled time to compare against.
+func (r *result) queueWait() time.Duration {
+	if r.scheduledAt.IsZero() {
+		return 0
+	}
+	return r.sentAt.Sub(r.scheduledAt)
+}
+
+// tlsCertInfo is the subset of an x509 certificate relevant to diagnosing a
+// handshake: who it was issued to and by, and its validity window.
+type tlsCertInfo struct {
+	Subject   string    `json:"subject"`
+	Issuer    string    `json:"issuer"`
+	NotBefore time.Time `json:"not_before"`
+	NotAfter  time.Time `json:"not_after"`
+	DNSNames  []string  `json:"dns_names,omitempty"`
+}
+
+func newTLSCertInfo(cert *x509.Certificate) tlsCertInfo {
+	return tlsCertInfo{
+		Subject:   cert.Subject.String(),
+		Issuer:    cert.Issuer.String(),
+		NotBefore: cert.NotBefore,
+		NotAfter:  cert.NotAfter,
+		DNSNames:  cert.DNSNames,
+	}
+}
+
+// tlsInfo captures the negotiated TLS parameters and peer certificate chain
+// for a request, including any verification error found by the manual
+// verifyPeerCertificates check newRequest's GotConn hook runs under -k.
+type tlsInfo struct {
+	Version     string        `json:"version"`
+	CipherSuite string        `json:"cipher_suite"`
+	ALPN        string        `json:"alpn,omitempty"`
+	ServerName  string        `json:"server_name,omitempty"`
+	Resumed     bool          `json:"resumed"`
+	PeerCerts   []tlsCertInfo `json:"peer_certificates,omitempty"`
+	VerifyError string        `json:"verify_error,omitempty"`
+}
+
+func tlsVersionName(version uint16) string {
+	switch version {
+	case tls.VersionTLS10:
+		return "TLS 1.0"
+	case tls.VersionTLS11:
+		return "TLS 1.1"
+	case tls.VersionTLS12:
+		return "TLS 1.2"
+	case tls.VersionTLS13:
+		return "TLS 1.3"
+	default:
+		return fmt.Sprintf("0x%04x", version)
+	}
+}
+
+// tlsSummary returns the TLS details for the request, or nil if it wasn't
+// made over TLS.
+func (r *result) tlsSummary() *tlsInfo {
+	if r.tlsState == nil {
+		return nil
+	}
+	cs := r.tlsState
+	info := &tlsInfo{
+		Version:     tlsVersionName(cs.Version),
+		CipherSuite: tls.CipherSuiteName(cs.CipherSuite),
+		ALPN:        cs.NegotiatedProtocol,
+		ServerName:  cs.ServerName,
+		Resumed:     cs.DidResume,
+	}
+	for _, cert := range cs.PeerCertificates {
+		info.PeerCerts = append(info.PeerCerts, newTLSCertInfo(cert))
+	}
+	if r.tlsVerifyErr != nil {
+		info.VerifyError = r.tlsVerifyErr.Error()
+	}
+	return info
+}
+
+func (i *tlsInfo) String() string {
+	var sb strings.Builder
+	sb.WriteString(fmt.Sprintf("  Version: %s, Cipher suite: %s, ALPN: %s, Resumed: %t\n", i.Version, i.CipherSuite, i.ALPN, i.Resumed))
+	if i.VerifyError != "" {
+		sb.WriteString(fmt.Sprintf("  Verification error: %s\n", i.VerifyError))
+	}
+	for _, cert := range i.PeerCerts {
+		sb.WriteString(fmt.Sprintf("  Cert: subject=%q issuer=%q notBefore=%s notAfter=%s\n",
+			cert.Subject, cert.Issuer, cert.NotBefore.Format(time.RFC3339), cert.NotAfter.Format(time.RFC3339)))
+	}
+	return sb.String()
+}
+
 func (r *result) String() string {
 	return fmt.Sprintf(
 		"%s %s - DNS: %s, TCP: %s, TLS: %s, Server processing: %s, Total: %s",
@@ -75,49 +190,463 @@ func main() {
 	}
 }
 
-func average(list []time.Duration) time.Duration {
-	var total time.Duration
-	for _, r := range list {
-		total += r
+// welford computes a running mean and variance in a single pass, so a
+// resultSummary never needs to retain sorted state between prints.
+type welford struct {
+	count int64
+	mean  float64
+	m2    float64
+}
+
+func (w *welford) add(x float64) {
+	w.count++
+	delta := x - w.mean
+	w.mean += delta / float64(w.count)
+	w.m2 += delta * (x - w.mean)
+}
+
+func (w *welford) stddev() time.Duration {
+	if w.count < 2 {
+		return 0
+	}
+	return time.Duration(math.Sqrt(w.m2 / float64(w.count)))
+}
+
+// phaseStats accumulates the samples for a single timing phase (e.g. DNS
+// lookup) across a test run, along with a running mean/stddev.
+type phaseStats struct {
+	samples []time.Duration
+	welford welford
+}
+
+func (p *phaseStats) add(d time.Duration) {
+	p.samples = append(p.samples, d)
+	p.welford.add(float64(d))
+}
+
+// percentile returns the p-th percentile (0 < p <= 1) of sorted, a slice
+// already ordered ascending.
+func percentile(sorted []time.Duration, p float64) time.Duration {
+	if len(sorted) == 0 {
+		return 0
+	}
+	idx := int(math.Ceil(p*float64(len(sorted)))) - 1
+	if idx < 0 {
+		idx = 0
+	}
+	if idx >= len(sorted) {
+		idx = len(sorted) - 1
+	}
+	return sorted[idx]
+}
+
+// sorted returns an ascending copy of the phase's samples, leaving p.samples
+// (and the load-order it reflects) untouched.
+func (p *phaseStats) sorted() []time.Duration {
+	sorted := make([]time.Duration, len(p.samples))
+	copy(sorted, p.samples)
+	sort.Slice(sorted, func(i, j int) bool { return sorted[i] < sorted[j] })
+	return sorted
+}
+
+// percentile returns the p-th percentile (0 < p <= 1) of the phase's samples.
+func (p *phaseStats) percentile(pct float64) time.Duration {
+	return percentile(p.sorted(), pct)
+}
+
+func (p *phaseStats) String() string {
+	if len(p.samples) == 0 {
+		return "n/a"
+	}
+	sorted := p.sorted()
+
+	return fmt.Sprintf(
+		"min=%s mean=%s max=%s stddev=%s p50=%s p90=%s p95=%s p99=%s p99.9=%s",
+		sorted[0],
+		time.Duration(p.welford.mean),
+		sorted[len(sorted)-1],
+		p.welford.stddev(),
+		percentile(sorted, 0.50),
+		percentile(sorted, 0.90),
+		percentile(sorted, 0.95),
+		percentile(sorted, 0.99),
+		percentile(sorted, 0.999),
+	)
+}
+
+// phaseStatsRecord is the machine-readable form of a phaseStats, used by the
+// JSON reporter's final summary object.
+type phaseStatsRecord struct {
+	MinNs    int64 `json:"min_ns"`
+	MeanNs   int64 `json:"mean_ns"`
+	MaxNs    int64 `json:"max_ns"`
+	StddevNs int64 `json:"stddev_ns"`
+	P50Ns    int64 `json:"p50_ns"`
+	P90Ns    int64 `json:"p90_ns"`
+	P95Ns    int64 `json:"p95_ns"`
+	P99Ns    int64 `json:"p99_ns"`
+	P999Ns   int64 `json:"p99_9_ns"`
+}
+
+func (p *phaseStats) record() phaseStatsRecord {
+	if len(p.samples) == 0 {
+		return phaseStatsRecord{}
+	}
+	sorted := p.sorted()
+	return phaseStatsRecord{
+		MinNs:    sorted[0].Nanoseconds(),
+		MeanNs:   int64(p.welford.mean),
+		MaxNs:    sorted[len(sorted)-1].Nanoseconds(),
+		StddevNs: p.welford.stddev().Nanoseconds(),
+		P50Ns:    percentile(sorted, 0.50).Nanoseconds(),
+		P90Ns:    percentile(sorted, 0.90).Nanoseconds(),
+		P95Ns:    percentile(sorted, 0.95).Nanoseconds(),
+		P99Ns:    percentile(sorted, 0.99).Nanoseconds(),
+		P999Ns:   percentile(sorted, 0.999).Nanoseconds(),
 	}
-	return total / time.Duration(len(list))
 }
 
 type resultSummary struct {
-	dnsLookups       []time.Duration
-	tcpConnects      []time.Duration
-	tlsHandshakes    []time.Duration
-	serverProcessing []time.Duration
-	roundTrips       []time.Duration
+	dnsLookups       phaseStats
+	tcpConnects      phaseStats
+	tlsHandshakes    phaseStats
+	serverProcessing phaseStats
+	roundTrips       phaseStats
+	queueWaits       phaseStats
+
+	// openModel is true when requests are being generated at a constant
+	// rate (-r) rather than in a closed loop, so queueWaits is meaningful.
+	openModel bool
+
+	// keepalive is true when -keepalive is set, so the connection-reuse
+	// breakdown is worth printing.
+	keepalive   bool
+	workerCount int
+
+	errors map[string]int
+
+	idleTimes          phaseStats
+	connsTotal         int
+	connsReused        int
+	freshConnsByWorker map[int]int
+	idlePutErrors      int
 }
 
 func (s *resultSummary) load(r *result) {
-	s.dnsLookups = append(s.dnsLookups, r.dnsLookup())
-	s.tcpConnects = append(s.tcpConnects, r.tcpConnect())
-	s.tlsHandshakes = append(s.tlsHandshakes, r.tlsHandshake())
-	s.serverProcessing = append(s.serverProcessing, r.serverProcessing())
-	s.roundTrips = append(s.roundTrips, r.roundTrip())
+	// A reused connection has no DNS/TCP/TLS phase of its own; including its
+	// near-zero durations here would pull the averages toward zero instead
+	// of reflecting the cost of actually establishing a connection.
+	if !r.connReused {
+		s.dnsLookups.add(r.dnsLookup())
+		s.tcpConnects.add(r.tcpConnect())
+		s.tlsHandshakes.add(r.tlsHandshake())
+	}
+	s.serverProcessing.add(r.serverProcessing())
+	s.roundTrips.add(r.roundTrip())
+	s.queueWaits.add(r.queueWait())
+	s.recordConn(r)
+}
+
+func (s *resultSummary) recordConn(r *result) {
+	s.connsTotal++
+	if r.connReused {
+		s.connsReused++
+		s.idleTimes.add(r.idleTime)
+	} else {
+		if s.freshConnsByWorker == nil {
+			s.freshConnsByWorker = make(map[int]int)
+		}
+		s.freshConnsByWorker[r.workerID]++
+	}
+	if r.putIdleErr != nil {
+		s.idlePutErrors++
+	}
+}
+
+func (s *resultSummary) recordError(err error) {
+	if s.errors == nil {
+		s.errors = make(map[string]int)
+	}
+	s.errors[err.Error()]++
+}
+
+// histogram renders a text histogram of round-trip times, bucketed into
+// exponentially-spaced bins starting at 1ms.
+func (s *resultSummary) histogram() string {
+	samples := s.roundTrips.samples
+	if len(samples) == 0 {
+		return ""
+	}
+
+	var max time.Duration
+	for _, d := range samples {
+		if d > max {
+			max = d
+		}
+	}
+
+	var bounds []time.Duration
+	for bound := time.Millisecond; ; bound *= 2 {
+		bounds = append(bounds, bound)
+		if bound > max {
+			break
+		}
+	}
+
+	counts := make([]int, len(bounds))
+	for _, d := range samples {
+		for i, bound := range bounds {
+			if d <= bound || i == len(bounds)-1 {
+				counts[i]++
+				break
+			}
+		}
+	}
+
+	maxCount := 0
+	for _, c := range counts {
+		if c > maxCount {
+			maxCount = c
+		}
+	}
+
+	const barWidth = 40
+	var sb strings.Builder
+	sb.WriteString("Round trip histogram:\n")
+	for i, bound := range bounds {
+		barLen := 0
+		if maxCount > 0 {
+			barLen = int(float64(counts[i]) / float64(maxCount) * barWidth)
+		}
+		sb.WriteString(fmt.Sprintf("  <= %-8s | %-40s %d\n", bound, strings.Repeat("#", barLen), counts[i]))
+	}
+	return sb.String()
 }
 
 func (s *resultSummary) String() string {
 	var sb strings.Builder
-	// todo: maybe use of templates would be better here
-	sb.WriteString(fmt.Sprintf("Average DNS lookup: %s\n", average(s.dnsLookups)))
-	sb.WriteString(fmt.Sprintf("Average TCP connect: %s\n", average(s.tcpConnects)))
-	sb.WriteString(fmt.Sprintf("Average TLS handshake: %s\n", average(s.tlsHandshakes)))
-	sb.WriteString(fmt.Sprintf("Average server processing: %s\n", average(s.serverProcessing)))
-	sb.WriteString(fmt.Sprintf("Average round trip: %s\n", average(s.roundTrips)))
+	sb.WriteString(fmt.Sprintf("DNS lookup:        %s\n", s.dnsLookups.String()))
+	sb.WriteString(fmt.Sprintf("TCP connect:       %s\n", s.tcpConnects.String()))
+	sb.WriteString(fmt.Sprintf("TLS handshake:     %s\n", s.tlsHandshakes.String()))
+	sb.WriteString(fmt.Sprintf("Server processing: %s\n", s.serverProcessing.String()))
+	sb.WriteString(fmt.Sprintf("Round trip:        %s\n", s.roundTrips.String()))
+	if s.openModel {
+		sb.WriteString(fmt.Sprintf("Queue wait:        %s\n", s.queueWaits.String()))
+	}
+	if s.keepalive {
+		sb.WriteString(s.connectionReuseSummary())
+	}
+	sb.WriteString(s.histogram())
+	if len(s.errors) > 0 {
+		sb.WriteString("Errors:\n")
+		for msg, count := range s.errors {
+			sb.WriteString(fmt.Sprintf("  %d x %s\n", count, msg))
+		}
+	}
+	return sb.String()
+}
+
+// connectionReuseSummary reports how often connections were reused versus
+// freshly dialed, and how many fresh connections each worker opened - the
+// number to watch when tuning MaxIdleConnsPerHost.
+func (s *resultSummary) connectionReuseSummary() string {
+	if s.connsTotal == 0 {
+		return ""
+	}
+
+	var sb strings.Builder
+	pct := float64(s.connsReused) / float64(s.connsTotal) * 100
+	sb.WriteString(fmt.Sprintf("Connection reuse: %d/%d (%.1f%%), avg idle time %s\n", s.connsReused, s.connsTotal, pct, time.Duration(s.idleTimes.welford.mean)))
+
+	for worker := 0; worker < s.workerCount; worker++ {
+		sb.WriteString(fmt.Sprintf("  worker %d opened %d connection(s)\n", worker, s.freshConnsByWorker[worker]))
+	}
+	if s.idlePutErrors > 0 {
+		sb.WriteString(fmt.Sprintf("  %d connection(s) failed to return to the idle pool\n", s.idlePutErrors))
+	}
 	return sb.String()
 }
 
+// resultRecord is the machine-readable form of a single result, used by the
+// JSON and CSV reporters.
+type resultRecord struct {
+	Timestamp time.Time `json:"ts"`
+	Proto     string    `json:"proto"`
+	Status    int       `json:"status"`
+	DNSNs     int64     `json:"dns_ns"`
+	TCPNs     int64     `json:"tcp_ns"`
+	TLSNs     int64     `json:"tls_ns"`
+	ServerNs  int64     `json:"server_ns"`
+	TotalNs   int64     `json:"total_ns"`
+	TLS       *tlsInfo  `json:"tls,omitempty"`
+}
+
+func newResultRecord(r *result) resultRecord {
+	return resultRecord{
+		Timestamp: r.roundTripStart,
+		Proto:     r.response.Proto,
+		Status:    r.response.StatusCode,
+		DNSNs:     r.dnsLookup().Nanoseconds(),
+		TCPNs:     r.tcpConnect().Nanoseconds(),
+		TLSNs:     r.tlsHandshake().Nanoseconds(),
+		ServerNs:  r.serverProcessing().Nanoseconds(),
+		TotalNs:   r.roundTrip().Nanoseconds(),
+		TLS:       r.tlsSummary(),
+	}
+}
+
+// summaryRecord is the machine-readable form of a resultSummary, emitted as
+// the final object by the JSON reporter.
+type summaryRecord struct {
+	Count     int               `json:"count"`
+	Errors    map[string]int    `json:"errors,omitempty"`
+	DNS       phaseStatsRecord  `json:"dns"`
+	TCP       phaseStatsRecord  `json:"tcp"`
+	TLS       phaseStatsRecord  `json:"tls"`
+	Server    phaseStatsRecord  `json:"server"`
+	RoundTrip phaseStatsRecord  `json:"round_trip"`
+	QueueWait *phaseStatsRecord `json:"queue_wait,omitempty"`
+}
+
+func newSummaryRecord(s *resultSummary) summaryRecord {
+	rec := summaryRecord{
+		Count:     len(s.roundTrips.samples),
+		Errors:    s.errors,
+		DNS:       s.dnsLookups.record(),
+		TCP:       s.tcpConnects.record(),
+		TLS:       s.tlsHandshakes.record(),
+		Server:    s.serverProcessing.record(),
+		RoundTrip: s.roundTrips.record(),
+	}
+	if s.openModel {
+		queueWait := s.queueWaits.record()
+		rec.QueueWait = &queueWait
+	}
+	return rec
+}
+
+// reporter decouples how results and the final summary are written from how
+// the test is run, so text/json/csv output can be selected with -o.
+type reporter interface {
+	OnResult(*result)
+	OnError(error)
+	Finalize(*resultSummary)
+}
+
+type textReporter struct {
+	out        io.Writer
+	tlsDetails bool
+}
+
+func (t *textReporter) OnResult(r *result) {
+	fmt.Fprintln(t.out, r)
+	if t.tlsDetails {
+		if info := r.tlsSummary(); info != nil {
+			fmt.Fprint(t.out, info)
+		}
+	}
+}
+
+func (t *textReporter) OnError(err error) {
+	fmt.Fprintf(t.out, "Error: %s\n", err)
+}
+
+func (t *textReporter) Finalize(s *resultSummary) {
+	fmt.Fprintln(t.out, s)
+}
+
+type jsonReporter struct {
+	enc *json.Encoder
+}
+
+func (j *jsonReporter) OnResult(r *result) {
+	j.enc.Encode(newResultRecord(r))
+}
+
+func (j *jsonReporter) OnError(err error) {
+	j.enc.Encode(struct {
+		Error string `json:"error"`
+	}{Error: err.Error()})
+}
+
+func (j *jsonReporter) Finalize(s *resultSummary) {
+	j.enc.Encode(newSummaryRecord(s))
+}
+
+var csvHeader = []string{"ts", "proto", "status", "dns_ns", "tcp_ns", "tls_ns", "server_ns", "total_ns"}
+
+type csvReporter struct {
+	w           *csv.Writer
+	wroteHeader bool
+}
+
+func (c *csvReporter) OnResult(r *result) {
+	if !c.wroteHeader {
+		c.w.Write(csvHeader)
+		c.wroteHeader = true
+	}
+	rec := newResultRecord(r)
+	c.w.Write([]string{
+		rec.Timestamp.Format(time.RFC3339Nano),
+		rec.Proto,
+		strconv.Itoa(rec.Status),
+		strconv.FormatInt(rec.DNSNs, 10),
+		strconv.FormatInt(rec.TCPNs, 10),
+		strconv.FormatInt(rec.TLSNs, 10),
+		strconv.FormatInt(rec.ServerNs, 10),
+		strconv.FormatInt(rec.TotalNs, 10),
+	})
+	c.w.Flush()
+}
+
+func (c *csvReporter) OnError(_ error) {}
+
+func (c *csvReporter) Finalize(_ *resultSummary) {
+	c.w.Flush()
+}
+
 func run(stdout io.Writer) error {
 	var url string
 	var concurrency int
 	var testDuration time.Duration
+	var method string
+	var dataStr string
+	var dataFile string
+	var insecure bool
+	var http1 bool
+	var keepalive bool
+	var ipv4 bool
+	var ipv6 bool
+	var sni string
+	var rate float64
+	var format string
+	var outputFile string
+	var tlsDetails bool
+
+	headers := &headerFlag{header: make(http.Header)}
+	resolve := &resolveFlag{resolve: make(map[string]string)}
 
 	flag.StringVar(&url, "u", "", "url to test")
 	flag.IntVar(&concurrency, "c", 1, "number of concurrent requests")
-	flag.DurationVar(&testDuration, "d", 10*time.Second, "time to run tests for")
+	flag.DurationVar(&testDuration, "duration", 10*time.Second, "time to run tests for")
+	flag.StringVar(&method, "X", "GET", "HTTP method to use")
+	flag.StringVar(&method, "method", "GET", "HTTP method to use")
+	flag.Var(headers, "H", "request header \"Key: Value\", repeatable")
+	flag.StringVar(&dataStr, "d", "", "request body data, or @file to read it from disk")
+	flag.StringVar(&dataStr, "data", "", "request body data, or @file to read it from disk")
+	flag.StringVar(&dataFile, "data-file", "", "read request body from file")
+	flag.BoolVar(&insecure, "k", false, "disable TLS certificate verification")
+	flag.BoolVar(&insecure, "insecure", false, "disable TLS certificate verification")
+	flag.BoolVar(&http1, "http1.1", false, "force HTTP/1.1, disabling HTTP/2 negotiation")
+	flag.BoolVar(&keepalive, "keepalive", false, "reuse connections across requests")
+	flag.BoolVar(&ipv4, "4", false, "use IPv4 addresses only")
+	flag.BoolVar(&ipv6, "6", false, "use IPv6 addresses only")
+	flag.StringVar(&sni, "sni", "", "TLS server name to present in the handshake")
+	flag.Var(resolve, "resolve", "pin a host to an address, \"host:addr\", repeatable")
+	flag.Float64Var(&rate, "r", 0, "requests per second; switches to constant-throughput (open-model) load instead of a closed loop")
+	flag.StringVar(&format, "o", "text", "output format: text, json or csv")
+	flag.StringVar(&outputFile, "output-file", "", "write -o output here instead of stdout; human progress still goes to stderr")
+	flag.BoolVar(&tlsDetails, "tls-details", false, "print negotiated TLS parameters and peer certificates per request in text mode")
 	flag.Parse()
 
 	if url == "" {
@@ -126,8 +655,87 @@ func run(stdout io.Writer) error {
 	if concurrency < 1 {
 		return errors.New("-c should be greater or equal to 1")
 	}
+	if ipv4 && ipv6 {
+		return errors.New("-4 and -6 are mutually exclusive")
+	}
+	if rate < 0 {
+		return errors.New("-r should be greater than 0")
+	}
+	switch format {
+	case "text", "json", "csv":
+	default:
+		return fmt.Errorf("-o should be one of text, json, csv, got %q", format)
+	}
+
+	var body []byte
+	switch {
+	case dataFile != "":
+		data, err := os.ReadFile(dataFile)
+		if err != nil {
+			return err
+		}
+		body = data
+	case strings.HasPrefix(dataStr, "@"):
+		data, err := os.ReadFile(strings.TrimPrefix(dataStr, "@"))
+		if err != nil {
+			return err
+		}
+		body = data
+	case dataStr != "":
+		body = []byte(dataStr)
+	}
+
+	network := ""
+	switch {
+	case ipv4:
+		network = "tcp4"
+	case ipv6:
+		network = "tcp6"
+	}
+
+	opts := requestOptions{
+		method:    method,
+		headers:   headers.header,
+		body:      body,
+		insecure:  insecure,
+		http1:     http1,
+		keepalive: keepalive,
+		network:   network,
+		sni:       sni,
+		resolve:   resolve.resolve,
+	}
 
-	fmt.Fprintf(stdout, "Running for %s with %d concurrent workers\n\n", testDuration, concurrency)
+	parsedURL, err := neturl.Parse(url)
+	if err != nil {
+		return err
+	}
+	transport := newTransport(opts, parsedURL.Hostname())
+
+	reportOut := stdout
+	progressOut := stdout
+	if outputFile != "" {
+		f, err := os.Create(outputFile)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		reportOut = f
+	}
+	if format != "text" || outputFile != "" {
+		progressOut = os.Stderr
+	}
+
+	var rep reporter
+	switch format {
+	case "json":
+		rep = &jsonReporter{enc: json.NewEncoder(reportOut)}
+	case "csv":
+		rep = &csvReporter{w: csv.NewWriter(reportOut)}
+	default:
+		rep = &textReporter{out: reportOut, tlsDetails: tlsDetails}
+	}
+
+	fmt.Fprintf(progressOut, "Running for %s with %d concurrent workers\n\n", testDuration, concurrency)
 
 	runtime.GOMAXPROCS(concurrency)
 
@@ -138,50 +746,173 @@ func run(stdout io.Writer) error {
 	interrupt := make(chan os.Signal, 1)
 	signal.Notify(interrupt, os.Interrupt)
 
-	for i := 0; i < concurrency; i++ {
-		go func(results chan *result, errs chan error) {
+	var interval time.Duration
+	if rate > 0 {
+		interval = time.Duration(float64(time.Second) / rate)
+		// schedule is fed by absolute arrival times (start + n*interval)
+		// queued in pending rather than relayed straight from the ticker:
+		// if workers fall behind, ticker.C would otherwise coalesce ticks
+		// and silently collapse the arrival rate down to server
+		// throughput. Queuing instead lets the backlog, and so queueWait,
+		// grow under backpressure, which is what the p99 warning below
+		// watches for.
+		schedule := make(chan time.Time)
+		go func() {
+			ticker := time.NewTicker(interval)
+			defer ticker.Stop()
+			start := time.Now()
+			var pending []time.Time
+			var n int64
 			for {
-				result := &result{}
-				err := runTest(url, result)
-				if err != nil {
-					errs <- err
+				if len(pending) == 0 {
+					<-ticker.C
+					n++
+					pending = append(pending, start.Add(time.Duration(n)*interval))
 					continue
 				}
-				results <- result
+				select {
+				case <-ticker.C:
+					n++
+					pending = append(pending, start.Add(time.Duration(n)*interval))
+				case schedule <- pending[0]:
+					pending = pending[1:]
+				}
 			}
-		}(results, errs)
+		}()
+		for i := 0; i < concurrency; i++ {
+			go func(workerID int, results chan *result, errs chan error) {
+				for scheduledAt := range schedule {
+					result := &result{workerID: workerID, scheduledAt: scheduledAt, sentAt: time.Now()}
+					err := runTest(url, result, opts, transport)
+					if err != nil {
+						errs <- err
+						continue
+					}
+					results <- result
+				}
+			}(i, results, errs)
+		}
+	} else {
+		for i := 0; i < concurrency; i++ {
+			go func(workerID int, results chan *result, errs chan error) {
+				for {
+					result := &result{workerID: workerID}
+					err := runTest(url, result, opts, transport)
+					if err != nil {
+						errs <- err
+						continue
+					}
+					results <- result
+				}
+			}(i, results, errs)
+		}
 	}
 
-	summary := &resultSummary{}
+	summary := &resultSummary{openModel: rate > 0, keepalive: keepalive, workerCount: concurrency}
+
+	printSummary := func() {
+		fmt.Fprintf(progressOut, "\nTest ended. %d requests made\n\n", len(summary.roundTrips.samples))
+		rep.Finalize(summary)
+		if rate > 0 {
+			if p99 := summary.queueWaits.percentile(0.99); p99 > 10*interval {
+				fmt.Fprintf(progressOut, "Warning: p99 queue wait (%s) exceeds 10x the %s request interval; the target rate of %g req/s can't be sustained (coordinated omission)\n", p99, interval, rate)
+			}
+		}
+	}
 
 	for {
 		select {
 		case <-done:
-			fmt.Fprintf(stdout, "\nTest ended. %d requests made\n\n", len(summary.roundTrips))
-			fmt.Fprintln(stdout, summary)
+			printSummary()
 			return nil
 		case <-interrupt:
-			// todo: cleanup this duplication with the done case above
-			fmt.Fprintf(stdout, "\nTest ended. %d requests made\n\n", len(summary.roundTrips))
-			fmt.Fprintln(stdout, summary)
+			printSummary()
 			signal.Stop(interrupt)
 			return errors.New("interrupt signal received")
 		case result := <-results:
 			summary.load(result)
-			fmt.Fprintln(stdout, result)
+			rep.OnResult(result)
 		case err := <-errs:
-			return err
+			summary.recordError(err)
+			rep.OnError(err)
 		}
 	}
 }
 
-func runTest(url string, result *result) error {
-	req, err := newRequest(url, result)
+// requestOptions bundles the per-request and per-transport customization
+// flags so they can be threaded through newRequest and newTransport without
+// a long, repeated parameter list.
+type requestOptions struct {
+	method    string
+	headers   http.Header
+	body      []byte
+	insecure  bool
+	http1     bool
+	keepalive bool
+	network   string // "", "tcp4" or "tcp6"
+	sni       string
+	resolve   map[string]string // host -> address
+}
+
+// serverName returns the TLS server name to present in the handshake and to
+// verify the peer certificate against: --sni if given, else the request host.
+func serverName(opts requestOptions, host string) string {
+	if opts.sni != "" {
+		return opts.sni
+	}
+	return host
+}
+
+// headerFlag implements flag.Value so repeated -H "Key: Value" flags
+// accumulate into an http.Header.
+type headerFlag struct {
+	header http.Header
+}
+
+func (h *headerFlag) String() string {
+	if h.header == nil {
+		return ""
+	}
+	return fmt.Sprintf("%v", h.header)
+}
+
+func (h *headerFlag) Set(value string) error {
+	key, val, ok := strings.Cut(value, ":")
+	if !ok {
+		return fmt.Errorf("invalid header %q, expected \"Key: Value\"", value)
+	}
+	h.header.Add(strings.TrimSpace(key), strings.TrimSpace(val))
+	return nil
+}
+
+// resolveFlag implements flag.Value so repeated --resolve host:addr flags
+// accumulate into a host->address map, pinning DNS resolution.
+type resolveFlag struct {
+	resolve map[string]string
+}
+
+func (r *resolveFlag) String() string {
+	if r.resolve == nil {
+		return ""
+	}
+	return fmt.Sprintf("%v", r.resolve)
+}
+
+func (r *resolveFlag) Set(value string) error {
+	host, addr, ok := strings.Cut(value, ":")
+	if !ok {
+		return fmt.Errorf("invalid --resolve %q, expected \"host:addr\"", value)
+	}
+	r.resolve[host] = addr
+	return nil
+}
+
+func runTest(url string, result *result, opts requestOptions, transport *http.Transport) error {
+	req, err := newRequest(url, result, opts)
 	if err != nil {
 		return err
 	}
 
-	transport := newTransport()
 	result.roundTripStart = time.Now()
 	response, err := transport.RoundTrip(req)
 	if err != nil {
@@ -190,29 +921,96 @@ func runTest(url string, result *result) error {
 	result.roundTripDone = time.Now()
 	result.response = response
 
-	return nil
+	// A connection is only returned to the transport's idle pool once its
+	// body is read to EOF and closed; skipping this leaks the connection
+	// (and, under -keepalive, defeats reuse entirely) as well as the fd.
+	if _, err := io.Copy(io.Discard, response.Body); err != nil {
+		response.Body.Close()
+		return err
+	}
+	return response.Body.Close()
+}
+
+// verifyPeerCertificates manually verifies a TLS peer's certificate chain
+// against serverName. It is used under -k, where InsecureSkipVerify has
+// disabled the default verification, so a benchmark run can still surface
+// "cert expired" / "hostname mismatch" style errors without aborting the
+// handshake.
+func verifyPeerCertificates(certs []*x509.Certificate, serverName string) error {
+	if len(certs) == 0 {
+		return nil
+	}
+	intermediates := x509.NewCertPool()
+	for _, cert := range certs[1:] {
+		intermediates.AddCert(cert)
+	}
+	_, err := certs[0].Verify(x509.VerifyOptions{
+		DNSName:       serverName,
+		Intermediates: intermediates,
+	})
+	return err
 }
 
-func newTransport() *http.Transport {
-	return &http.Transport{
-		Proxy: http.ProxyFromEnvironment,
-		DialContext: (&net.Dialer{
-			Timeout:   30 * time.Second,
-			DualStack: true,
-		}).DialContext,
-		DisableKeepAlives:     true,
+// newTransport builds the shared http.Transport used for every request in a
+// run, so that -keepalive can actually reuse connections: a fresh transport
+// per request would throw its connection pool away each time.
+func newTransport(opts requestOptions, host string) *http.Transport {
+	dialer := &net.Dialer{
+		Timeout:   30 * time.Second,
+		DualStack: true,
+	}
+
+	dialContext := func(ctx context.Context, network, addr string) (net.Conn, error) {
+		if opts.network != "" {
+			network = opts.network
+		}
+		if host, port, err := net.SplitHostPort(addr); err == nil {
+			if resolved, ok := opts.resolve[host]; ok {
+				addr = net.JoinHostPort(resolved, port)
+			}
+		}
+		return dialer.DialContext(ctx, network, addr)
+	}
+
+	transport := &http.Transport{
+		Proxy:       http.ProxyFromEnvironment,
+		DialContext: dialContext,
+		TLSClientConfig: &tls.Config{
+			InsecureSkipVerify: opts.insecure,
+			ServerName:         serverName(opts, host),
+		},
+		DisableKeepAlives:     !opts.keepalive,
 		ForceAttemptHTTP2:     true,
 		MaxIdleConns:          100,
 		TLSHandshakeTimeout:   10 * time.Second,
 		ExpectContinueTimeout: 1 * time.Second,
 	}
+
+	if opts.http1 {
+		transport.ForceAttemptHTTP2 = false
+		transport.TLSNextProto = map[string]func(string, *tls.Conn) http.RoundTripper{}
+	}
+
+	return transport
 }
 
-func newRequest(url string, result *result) (*http.Request, error) {
-	req, err := http.NewRequest("GET", url, nil)
+func newRequest(url string, result *result, opts requestOptions) (*http.Request, error) {
+	var body io.Reader
+	if len(opts.body) > 0 {
+		body = bytes.NewReader(opts.body)
+	}
+
+	req, err := http.NewRequest(opts.method, url, body)
 	if err != nil {
 		return nil, err
 	}
+	for key, values := range opts.headers {
+		for _, value := range values {
+			req.Header.Add(key, value)
+		}
+	}
+
+	name := serverName(opts, req.URL.Hostname())
 
 	ctx := req.Context()
 	trace := &httptrace.ClientTrace{
@@ -228,8 +1026,23 @@ func newRequest(url string, result *result) (*http.Request, error) {
 		ConnectDone: func(_, _ string, _ error) {
 			result.connectDone = time.Now()
 		},
-		GotConn: func(_ httptrace.GotConnInfo) {
+		GotConn: func(info httptrace.GotConnInfo) {
 			result.conn = time.Now()
+			result.connReused = info.Reused
+			result.wasIdle = info.WasIdle
+			result.idleTime = info.IdleTime
+
+			// GotConnInfo.Conn is the actual connection this request is
+			// using, reused or not, so read the TLS state off it directly
+			// rather than relying on TLSHandshakeDone, which only fires
+			// when a fresh handshake happens on this request.
+			if tlsConn, ok := info.Conn.(*tls.Conn); ok {
+				cs := tlsConn.ConnectionState()
+				result.tlsState = &cs
+				if opts.insecure {
+					result.tlsVerifyErr = verifyPeerCertificates(cs.PeerCertificates, name)
+				}
+			}
 		},
 		GotFirstResponseByte: func() {
 			result.firstResponseByte = time.Now()
@@ -240,6 +1053,9 @@ func newRequest(url string, result *result) (*http.Request, error) {
 		TLSHandshakeDone: func(_ tls.ConnectionState, _ error) {
 			result.tlsHandshakeDone = time.Now()
 		},
+		PutIdleConn: func(err error) {
+			result.putIdleErr = err
+		},
 	}
 
 	return req.WithContext(httptrace.WithClientTrace(ctx, trace)), nil